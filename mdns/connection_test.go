@@ -15,7 +15,10 @@ func TestCreateClientOptions(t *testing.T) {
 
 	onLost := func(c mqtt.Client, err error) {}
 
-	opts := createClientOptions(clientId, uri, onConnect, onLost)
+	opts, err := createClientOptions(clientId, uri, TLSConfig{}, "mesh", onConnect, onLost)
+	if err != nil {
+		t.Fatalf("unexpected error building client options: %v", err)
+	}
 
 	if opts.ClientID != clientId {
 		t.Errorf("Expected ClientID %s, got %s", clientId, opts.ClientID)
@@ -39,3 +42,50 @@ func TestCreateClientOptions(t *testing.T) {
 	// but strict function equality in Go is not possible.
 	// This is a basic sanity check that we are setting them.
 }
+
+func TestCreateClientOptionsTLS(t *testing.T) {
+	uri, _ := url.Parse("ssl://localhost:8883")
+	onConnect := func(c mqtt.Client) {}
+	onLost := func(c mqtt.Client, err error) {}
+
+	opts, err := createClientOptions("test-client", uri, TLSConfig{Insecure: true}, "mesh", onConnect, onLost)
+	if err != nil {
+		t.Fatalf("unexpected error building client options: %v", err)
+	}
+
+	if opts.TLSConfig.InsecureSkipVerify != true {
+		t.Error("Expected InsecureSkipVerify to be true")
+	}
+}
+
+func TestCreateClientOptionsTLSMissingCert(t *testing.T) {
+	uri, _ := url.Parse("ssl://localhost:8883")
+	onConnect := func(c mqtt.Client) {}
+	onLost := func(c mqtt.Client, err error) {}
+
+	_, err := createClientOptions("test-client", uri, TLSConfig{CertFile: "/no/such/cert.pem", KeyFile: "/no/such/key.pem"}, "mesh", onConnect, onLost)
+	if err == nil {
+		t.Error("Expected error loading missing client certificate, got nil")
+	}
+}
+
+func TestCreateClientOptionsPreservesPath(t *testing.T) {
+	uri, _ := url.Parse("wss://broker.example.com/mqtt?foo=bar")
+	onConnect := func(c mqtt.Client) {}
+	onLost := func(c mqtt.Client, err error) {}
+
+	opts, err := createClientOptions("test-client", uri, TLSConfig{}, "mesh", onConnect, onLost)
+	if err != nil {
+		t.Fatalf("unexpected error building client options: %v", err)
+	}
+
+	if len(opts.Servers) != 1 {
+		t.Fatalf("expected exactly one broker, got %d", len(opts.Servers))
+	}
+
+	got := opts.Servers[0].String()
+	want := "wss://broker.example.com/mqtt?foo=bar"
+	if got != want {
+		t.Errorf("broker URL = %q, want %q", got, want)
+	}
+}
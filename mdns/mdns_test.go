@@ -0,0 +1,61 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+// BenchmarkWriteToPerPacket exercises the unbatched write path: one
+// WriteTo syscall per interface per message.
+func BenchmarkWriteToPerPacket(b *testing.B) {
+	pc, dst := newLoopbackConn(b)
+	defer pc.Close()
+	data := make([]byte, 512)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < defaultBatchSize; j++ {
+			if _, err := pc.WriteTo(data, nil, dst); err != nil {
+				b.Fatalf("WriteTo: %v", err)
+			}
+		}
+	}
+}
+
+// BenchmarkWriteBatch exercises the batched write path that
+// handleMeshMessage uses: a single
+// WriteBatch syscall for the same number of messages.
+func BenchmarkWriteBatch(b *testing.B) {
+	pc, dst := newLoopbackConn(b)
+	defer pc.Close()
+	data := make([]byte, 512)
+
+	msgs := make([]ipv4.Message, defaultBatchSize)
+	for i := range msgs {
+		msgs[i] = ipv4.Message{Buffers: [][]byte{data}, Addr: dst}
+	}
+
+	if _, err := pc.WriteBatch(msgs, 0); err != nil {
+		b.Skipf("WriteBatch unsupported on this platform: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pc.WriteBatch(msgs, 0); err != nil {
+			b.Fatalf("WriteBatch: %v", err)
+		}
+	}
+}
+
+func newLoopbackConn(b *testing.B) (*ipv4.PacketConn, net.Addr) {
+	b.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		b.Skipf("unable to open loopback UDP socket: %v", err)
+	}
+
+	return ipv4.NewPacketConn(conn), conn.LocalAddr()
+}
@@ -0,0 +1,258 @@
+package mdns
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+// Direction records which way a message is flowing through the pipeline:
+// Inbound is wire-to-mesh (captured locally, about to be published),
+// Outbound is mesh-to-wire (received from a peer, about to be transmitted).
+type Direction string
+
+const (
+	DirectionInbound  Direction = "inbound"
+	DirectionOutbound Direction = "outbound"
+)
+
+// PacketMeta is the context a Stage gets alongside the parsed message.
+type PacketMeta struct {
+	SourceIP  net.IP
+	Interface string
+	Direction Direction
+}
+
+// StageConfig describes one pipeline stage, as loaded from YAML. Which
+// fields apply depends on Type.
+type StageConfig struct {
+	// Type selects the stage: "match_service", "rewrite_labels",
+	// "rate_limit", or "route_topic".
+	Type string `yaml:"type"`
+
+	// Match is a label regex used by match_service and route_topic.
+	Match string `yaml:"match,omitempty"`
+	// Deny inverts match_service: drop on match instead of requiring one.
+	Deny bool `yaml:"deny,omitempty"`
+
+	// Rename is a set of exact label substitutions for rewrite_labels.
+	Rename map[string]string `yaml:"rename,omitempty"`
+
+	// Rate and Burst configure rate_limit's per-service token bucket.
+	Rate  float64 `yaml:"rate,omitempty"`
+	Burst int     `yaml:"burst,omitempty"`
+
+	// Topic is the MQTT sub-topic route_topic sends matches to.
+	Topic string `yaml:"topic,omitempty"`
+}
+
+// stageAction is the verdict a Stage reaches for one message.
+type stageAction int
+
+const (
+	actionAccept stageAction = iota
+	actionDrop
+)
+
+// stageResult is what a Stage hands back to the pipeline: a verdict, the
+// (possibly rewritten) message, and an optional topic override.
+type stageResult struct {
+	action stageAction
+	msg    dns.Msg
+	topic  string
+}
+
+// Stage is one step of the filter/topic-mapping pipeline.
+type Stage interface {
+	Name() string
+	Apply(msg dns.Msg, meta PacketMeta) stageResult
+}
+
+// Pipeline runs an ordered list of Stages over a message, stopping early
+// on the first drop.
+type Pipeline struct {
+	stages []Stage
+}
+
+// NewPipeline builds a Pipeline from its YAML-loaded stage configs.
+func NewPipeline(configs []StageConfig) (*Pipeline, error) {
+	p := &Pipeline{}
+
+	for i, c := range configs {
+		stage, err := newStage(c)
+		if err != nil {
+			return nil, fmt.Errorf("error building filter pipeline stage %d: %v", i, err)
+		}
+		p.stages = append(p.stages, stage)
+	}
+
+	return p, nil
+}
+
+// Run passes msg through every stage in order. ok is false if any stage
+// dropped the message. topic is the last non-empty override a route_topic
+// stage set, or "" if none did.
+func (p *Pipeline) Run(msg dns.Msg, meta PacketMeta) (out dns.Msg, topic string, ok bool) {
+	out = msg
+
+	for _, stage := range p.stages {
+		res := stage.Apply(out, meta)
+		if res.action == actionDrop {
+			return out, topic, false
+		}
+
+		out = res.msg
+		if res.topic != "" {
+			topic = res.topic
+		}
+	}
+
+	return out, topic, true
+}
+
+func newStage(c StageConfig) (Stage, error) {
+	switch c.Type {
+	case "match_service":
+		re, err := regexp.Compile(c.Match)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling match_service regex '%s': %v", c.Match, err)
+		}
+		return &matchServiceStage{re: re, deny: c.Deny}, nil
+	case "rewrite_labels":
+		return &rewriteLabelsStage{rename: c.Rename}, nil
+	case "rate_limit":
+		return &rateLimitStage{rate: rate.Limit(c.Rate), burst: c.Burst, limiters: make(map[string]*rate.Limiter)}, nil
+	case "route_topic":
+		re, err := regexp.Compile(c.Match)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling route_topic regex '%s': %v", c.Match, err)
+		}
+		return &routeTopicStage{re: re, topic: c.Topic}, nil
+	default:
+		return nil, fmt.Errorf("unknown filter pipeline stage type '%s'", c.Type)
+	}
+}
+
+// matchServiceStage accepts only messages whose labels match re (or, with
+// deny set, drops messages whose labels match re).
+type matchServiceStage struct {
+	re   *regexp.Regexp
+	deny bool
+}
+
+func (s *matchServiceStage) Name() string { return "MatchService" }
+
+func (s *matchServiceStage) Apply(msg dns.Msg, meta PacketMeta) stageResult {
+	match := labelMatch(msg, []*regexp.Regexp{s.re})
+	if match != s.deny {
+		return stageResult{action: actionAccept, msg: msg}
+	}
+	return stageResult{action: actionDrop, msg: msg}
+}
+
+// rewriteLabelsStage substitutes exact question/answer label names,
+// e.g. to strip an internal domain suffix before it reaches the mesh.
+type rewriteLabelsStage struct {
+	rename map[string]string
+}
+
+func (s *rewriteLabelsStage) Name() string { return "RewriteLabels" }
+
+func (s *rewriteLabelsStage) Apply(msg dns.Msg, meta PacketMeta) stageResult {
+	for i, q := range msg.Question {
+		if to, ok := s.rename[strings.TrimSuffix(q.Name, ".")]; ok {
+			msg.Question[i].Name = dns.Fqdn(to)
+		}
+	}
+
+	for i, a := range msg.Answer {
+		if to, ok := s.rename[strings.TrimSuffix(a.Header().Name, ".")]; ok {
+			msg.Answer[i].Header().Name = dns.Fqdn(to)
+		}
+	}
+
+	return stageResult{action: actionAccept, msg: msg}
+}
+
+// rateLimitStage enforces a per-service-name token bucket so a single
+// misbehaving device can't flood the mesh.
+type rateLimitStage struct {
+	rate  rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func (s *rateLimitStage) Name() string { return "RateLimit" }
+
+func (s *rateLimitStage) Apply(msg dns.Msg, meta PacketMeta) stageResult {
+	name := serviceName(msg)
+	if name == "" {
+		return stageResult{action: actionAccept, msg: msg}
+	}
+
+	s.mu.Lock()
+	limiter, ok := s.limiters[name]
+	if !ok {
+		limiter = rate.NewLimiter(s.rate, s.burst)
+		s.limiters[name] = limiter
+	}
+	s.mu.Unlock()
+
+	if !limiter.Allow() {
+		return stageResult{action: actionDrop, msg: msg}
+	}
+
+	return stageResult{action: actionAccept, msg: msg}
+}
+
+// routeTopicStage maps messages whose labels match re onto a dedicated
+// MQTT sub-topic, so large meshes can shard traffic by service.
+type routeTopicStage struct {
+	re    *regexp.Regexp
+	topic string
+}
+
+func (s *routeTopicStage) Name() string { return "RouteTopic" }
+
+func (s *routeTopicStage) Apply(msg dns.Msg, meta PacketMeta) stageResult {
+	if !labelMatch(msg, []*regexp.Regexp{s.re}) {
+		return stageResult{action: actionAccept, msg: msg}
+	}
+	return stageResult{action: actionAccept, msg: msg, topic: s.topic}
+}
+
+// routeTopics returns the distinct sub-topics configured across every
+// route_topic stage, used to subscribe beyond the single default topic.
+func routeTopics(configs []StageConfig) []string {
+	var topics []string
+	seen := make(map[string]bool)
+
+	for _, c := range configs {
+		if c.Type != "route_topic" || c.Topic == "" || seen[c.Topic] {
+			continue
+		}
+		seen[c.Topic] = true
+		topics = append(topics, c.Topic)
+	}
+
+	return topics
+}
+
+// serviceName returns the first question/answer label, used as the
+// rate-limit bucket key.
+func serviceName(msg dns.Msg) string {
+	if len(msg.Question) > 0 {
+		return strings.TrimSuffix(msg.Question[0].Name, ".")
+	}
+	if len(msg.Answer) > 0 {
+		return strings.TrimSuffix(msg.Answer[0].Header().Name, ".")
+	}
+	return ""
+}
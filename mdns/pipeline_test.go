@@ -0,0 +1,89 @@
+package mdns
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+func questionMsg(name string) dns.Msg {
+	m := dns.Msg{}
+	m.Question = []dns.Question{{Name: dns.Fqdn(name)}}
+	return m
+}
+
+func TestMatchServiceStageApply(t *testing.T) {
+	re := regexp.MustCompile("^_googlecast._tcp.local$")
+
+	tests := []struct {
+		name   string
+		deny   bool
+		msg    dns.Msg
+		accept bool
+	}{
+		{"allow mode, match", false, questionMsg("_googlecast._tcp.local"), true},
+		{"allow mode, no match", false, questionMsg("_airplay._tcp.local"), false},
+		{"deny mode, match", true, questionMsg("_googlecast._tcp.local"), false},
+		{"deny mode, no match", true, questionMsg("_airplay._tcp.local"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stage := &matchServiceStage{re: re, deny: tt.deny}
+			res := stage.Apply(tt.msg, PacketMeta{})
+
+			accepted := res.action == actionAccept
+			if accepted != tt.accept {
+				t.Errorf("Apply() accepted = %v, want %v", accepted, tt.accept)
+			}
+		})
+	}
+}
+
+func TestRewriteLabelsStageApply(t *testing.T) {
+	stage := &rewriteLabelsStage{rename: map[string]string{"internal.local": "public.local"}}
+
+	res := stage.Apply(questionMsg("internal.local"), PacketMeta{})
+
+	if res.action != actionAccept {
+		t.Fatalf("Apply() action = %v, want actionAccept", res.action)
+	}
+
+	got := res.msg.Question[0].Name
+	want := dns.Fqdn("public.local")
+	if got != want {
+		t.Errorf("Apply() renamed question = %q, want %q", got, want)
+	}
+}
+
+func TestRouteTopicStageApply(t *testing.T) {
+	stage := &routeTopicStage{re: regexp.MustCompile("^_googlecast._tcp.local$"), topic: "mesh/cast"}
+
+	match := stage.Apply(questionMsg("_googlecast._tcp.local"), PacketMeta{})
+	if match.action != actionAccept || match.topic != "mesh/cast" {
+		t.Errorf("Apply() on match = %+v, want accept with topic mesh/cast", match)
+	}
+
+	noMatch := stage.Apply(questionMsg("_airplay._tcp.local"), PacketMeta{})
+	if noMatch.action != actionAccept || noMatch.topic != "" {
+		t.Errorf("Apply() on non-match = %+v, want accept with no topic override", noMatch)
+	}
+}
+
+func TestRateLimitStageApply(t *testing.T) {
+	stage := &rateLimitStage{rate: 0, burst: 1, limiters: make(map[string]*rate.Limiter)}
+
+	msg := questionMsg("_googlecast._tcp.local")
+
+	first := stage.Apply(msg, PacketMeta{})
+	if first.action != actionAccept {
+		t.Fatalf("Apply() first call = %v, want actionAccept", first.action)
+	}
+
+	second := stage.Apply(msg, PacketMeta{})
+	if second.action != actionDrop {
+		t.Errorf("Apply() second call after burst spent = %v, want actionDrop", second.action)
+	}
+}
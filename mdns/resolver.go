@@ -0,0 +1,164 @@
+package mdns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Service is one answer collected by Resolver.Scan, aggregated from a
+// PTR/SRV/TXT/A/AAAA answer set seen on some segment of the mesh.
+type Service struct {
+	Name    string
+	AddrV4  net.IP
+	AddrV6  net.IP
+	Port    uint16
+	TXT     []string
+	Device  string
+	Segment string
+}
+
+// Resolver issues on-demand mDNS service queries across every segment of
+// the mesh, not just the link Server is attached to.
+type Resolver struct {
+	s *Server
+}
+
+// NewResolver returns a Resolver that queries across the mesh s is part of.
+func NewResolver(s *Server) *Resolver {
+	return &Resolver{s: s}
+}
+
+// Scan queries for service (e.g. "_googlecast._tcp.local.") and returns a
+// channel of deduplicated Service answers gathered from every segment of
+// the mesh. The channel is closed once timeout elapses or ctx is done.
+func (r *Resolver) Scan(ctx context.Context, service string, timeout time.Duration) (<-chan Service, error) {
+	queryID, err := newQueryID()
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile(regexp.QuoteMeta(strings.TrimSuffix(service, ".")))
+	if err != nil {
+		return nil, fmt.Errorf("error compiling service regex for '%s': %v", service, err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(service), dns.TypePTR)
+	q.Id = 0 // mDNS queries are always sent with the ID zeroed; responders don't echo it back
+	q.RecursionDesired = false
+
+	data, err := q.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("error building resolver query for '%s': %v", service, err)
+	}
+
+	results := make(chan Service, 64)
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+
+	r.s.registerQuery(queryID, re, func(dm dns.Msg, segment string) {
+		for _, svc := range servicesFromAnswer(dm, segment) {
+			key := fmt.Sprintf("%s|%s|%s|%d|%s", svc.Name, svc.AddrV4, svc.AddrV6, svc.Port, svc.Segment)
+
+			mu.Lock()
+			duplicate := seen[key]
+			seen[key] = true
+			mu.Unlock()
+			if duplicate {
+				continue
+			}
+
+			select {
+			case results <- svc:
+			default:
+				log.Warnf("Resolver result channel full, dropping answer for %s", svc.Name)
+			}
+		}
+	})
+
+	families := r.s.activeFamilies()
+	if len(families) == 0 {
+		r.s.unregisterQuery(queryID)
+		return nil, fmt.Errorf("no multicast family is enabled on this node")
+	}
+
+	for _, family := range families {
+		if err := r.s.injectQuery(data, family); err != nil {
+			log.Debugf("Unable to transmit resolver query onto local %s wire: %v", family, err)
+		}
+
+		if err := r.s.transport.Publish(r.s.config.Topic, Msg{Sender: r.s.uniqueID, Data: data, Family: family, QueryID: queryID}); err != nil {
+			r.s.unregisterQuery(queryID)
+			return nil, fmt.Errorf("error publishing resolver query to mesh: %v", err)
+		}
+	}
+
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+
+		r.s.unregisterQuery(queryID)
+		close(results)
+	}()
+
+	return results, nil
+}
+
+// servicesFromAnswer aggregates the records of a single mDNS response
+// into one Service. mDNS responders usually bundle PTR/SRV/TXT/A/AAAA for
+// a service instance into one answer set, so this treats the whole
+// message as describing a single instance rather than iterating records
+// independently.
+func servicesFromAnswer(dm dns.Msg, segment string) []Service {
+	if !dm.Response || len(dm.Answer) == 0 {
+		return nil
+	}
+
+	var svc Service
+	for _, rr := range dm.Answer {
+		switch rec := rr.(type) {
+		case *dns.PTR:
+			svc.Name = strings.TrimSuffix(rec.Ptr, ".")
+		case *dns.SRV:
+			svc.Device = strings.TrimSuffix(rec.Target, ".")
+			svc.Port = rec.Port
+		case *dns.TXT:
+			svc.TXT = rec.Txt
+		case *dns.A:
+			svc.AddrV4 = rec.A
+		case *dns.AAAA:
+			svc.AddrV6 = rec.AAAA
+		}
+	}
+
+	if svc.Name == "" {
+		return nil
+	}
+
+	svc.Segment = segment
+	return []Service{svc}
+}
+
+func newQueryID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating resolver query id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
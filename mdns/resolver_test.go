@@ -0,0 +1,100 @@
+package mdns
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServicesFromAnswer(t *testing.T) {
+	m := dns.Msg{}
+	m.Response = true
+	m.Answer = []dns.RR{
+		&dns.PTR{Hdr: dns.RR_Header{Name: "_googlecast._tcp.local."}, Ptr: "living-room._googlecast._tcp.local."},
+		&dns.SRV{Hdr: dns.RR_Header{Name: "living-room._googlecast._tcp.local."}, Target: "living-room.local.", Port: 8009},
+		&dns.A{Hdr: dns.RR_Header{Name: "living-room.local."}, A: net.ParseIP("192.0.2.10")},
+	}
+
+	svcs := servicesFromAnswer(m, "vlan10")
+	if len(svcs) != 1 {
+		t.Fatalf("servicesFromAnswer() returned %d services, want 1", len(svcs))
+	}
+
+	svc := svcs[0]
+	if svc.Name != "living-room._googlecast._tcp.local" {
+		t.Errorf("Name = %q, want %q", svc.Name, "living-room._googlecast._tcp.local")
+	}
+	if svc.Device != "living-room.local" {
+		t.Errorf("Device = %q, want %q", svc.Device, "living-room.local")
+	}
+	if svc.Port != 8009 {
+		t.Errorf("Port = %d, want 8009", svc.Port)
+	}
+	if svc.Segment != "vlan10" {
+		t.Errorf("Segment = %q, want %q", svc.Segment, "vlan10")
+	}
+}
+
+func TestServicesFromAnswerIgnoresQueries(t *testing.T) {
+	m := dns.Msg{}
+	m.Response = false
+	m.Question = []dns.Question{{Name: "_googlecast._tcp.local."}}
+
+	if svcs := servicesFromAnswer(m, "vlan10"); svcs != nil {
+		t.Errorf("servicesFromAnswer() on a query = %+v, want nil", svcs)
+	}
+}
+
+// TestDeliverQueryResultRaceWithUnregister mirrors the race between
+// Scan's timeout goroutine (unregisterQuery then close(results)) and a
+// peer answer arriving via deliverQueryResult: under the pre-a8d9cad
+// code this could send on a closed channel. Run with -race; it
+// regresses if notify ever escapes queriesMu again.
+func TestDeliverQueryResultRaceWithUnregister(t *testing.T) {
+	dm := dns.Msg{}
+	dm.Response = true
+	dm.Answer = []dns.RR{&dns.PTR{Hdr: dns.RR_Header{Name: "_test._tcp.local."}, Ptr: "device._test._tcp.local."}}
+
+	for i := 0; i < 200; i++ {
+		s := &Server{}
+		queryID := fmt.Sprintf("race-%d", i)
+		results := make(chan Service, 1)
+
+		s.registerQuery(queryID, regexp.MustCompile(".*"), func(dm dns.Msg, segment string) {
+			for _, svc := range servicesFromAnswer(dm, segment) {
+				results <- svc
+			}
+		})
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.deliverQueryResult(queryID, dm, "ipv4")
+		}()
+		go func() {
+			defer wg.Done()
+			s.unregisterQuery(queryID)
+			close(results)
+		}()
+		wg.Wait()
+	}
+}
+
+func TestNewQueryIDUnique(t *testing.T) {
+	a, err := newQueryID()
+	if err != nil {
+		t.Fatalf("newQueryID() error = %v", err)
+	}
+	b, err := newQueryID()
+	if err != nil {
+		t.Fatalf("newQueryID() error = %v", err)
+	}
+	if a == b {
+		t.Errorf("newQueryID() returned the same id twice: %s", a)
+	}
+}
@@ -1,6 +1,8 @@
 package mdns
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/denisbrodbeck/machineid"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hashicorp/memberlist"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/ipv4"
@@ -24,20 +27,54 @@ const (
 	ipv6mdns = "ff02::fb"
 	mdnsPort = 5353
 	bufSize  = 65536
+
+	defaultBatchSize = 32
+	defaultWorkers   = 4
+
+	// relayQueryTimeout is how long a node keeps forwarding answers for a
+	// Resolver query relayed to it by a peer.
+	relayQueryTimeout = 30 * time.Second
 )
 
 type Config struct {
 	AllowFilter []string
+	BatchSize   int
 	DenyFilter  []string
 	DenyIP      []string
+	DisableIPv4 bool
+	DisableIPv6 bool
+	Filters     []StageConfig
 	FilterTTL   int
+	Gossip      GossipConfig
 	HighPort    bool
 	ListenIP    string
 	Monitor     []string
 	PortFilter  []string
 	Server      *url.URL
+	TLS         TLSConfig
 	Topic       string
+	Transport   string
 	UniqueID    string
+	Workers     int
+}
+
+// TLSConfig holds the settings needed to dial an ssl:// or wss:// broker,
+// including mTLS client authentication.
+type TLSConfig struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	Insecure   bool
+}
+
+// GossipConfig holds the settings for the memberlist-based "gossip"
+// transport, used in place of an MQTT broker.
+type GossipConfig struct {
+	BindAddr      string
+	EncryptionKey string
+	ProbeInterval time.Duration
+	Seeds         []string
 }
 
 type Server struct {
@@ -49,23 +86,48 @@ type Server struct {
 	ipv4High *ipv4.PacketConn
 	ipv4Low  *ipv4.PacketConn
 
+	ipv6CMs  []*ipv6.ControlMessage
 	ipv6Dst  *net.UDPAddr
 	ipv6High *ipv6.PacketConn
 	ipv6Low  *ipv6.PacketConn
 
 	filterDeny  bool
 	filterRegex []*regexp.Regexp
+	pipeline    *Pipeline
 	portRegex   []*regexp.Regexp
-	client      mqtt.Client
+	transport   Transport
 	wg          sync.WaitGroup
+
+	queriesMu sync.Mutex
+	queries   map[string]*activeQuery
+}
+
+// activeQuery is a Resolver scan this node either originated or is
+// relaying the matching answers for.
+type activeQuery struct {
+	re     *regexp.Regexp
+	notify func(dm dns.Msg, segment string)
 }
 
 type Msg struct {
 	Sender string
 	Data   []byte
+	// Family is "ipv4" or "ipv6" and records which multicast wire Data was
+	// captured from, so peers rebroadcast it on the matching socket.
+	Family string
+	// QueryID, when set, marks Data as belonging to an active Resolver
+	// scan rather than ordinary relayed mDNS traffic: a query (QR=0) is
+	// transmitted onto the receiving node's local wire instead of being
+	// relayed as-is, and an answer (QR=1) is delivered to the matching
+	// registered query instead of being rebroadcast.
+	QueryID string
 }
 
 func StartServer(config Config) error {
+	if config.DisableIPv4 && config.DisableIPv6 {
+		return fmt.Errorf("cannot disable both IPv4 and IPv6")
+	}
+
 	uniqueID, err := getUniqueID(config)
 	if err != nil {
 		return err
@@ -81,53 +143,92 @@ func StartServer(config Config) error {
 		return err
 	}
 
-	cms, err := getCM4(config, ifs)
-	if err != nil {
-		return err
-	}
-
-	ipv4Low, err := listener4(config, ifs, mdnsPort)
-	if err != nil {
-		return err
-	}
-	ipv4High, err := listener4(config, ifs, 0)
-	if err != nil {
-		return err
-	}
-
-	ipv4Dst := &net.UDPAddr{
-		IP:   net.ParseIP(ipv4mdns),
-		Port: 5353,
-	}
-
 	s := &Server{
 		config:      config,
 		filterDeny:  filterDeny,
 		filterRegex: filterRegex,
-		ipv4CMs:     cms,
-		ipv4Dst:     ipv4Dst,
-		ipv4High:    ipv4High,
-		ipv4Low:     ipv4Low,
 		portRegex:   portRegex,
 		uniqueID:    uniqueID,
 	}
 
-	c, err := connect(uniqueID, config.Server)
+	if len(config.Filters) > 0 {
+		pipeline, err := NewPipeline(config.Filters)
+		if err != nil {
+			return err
+		}
+		s.pipeline = pipeline
+	}
+
+	if !config.DisableIPv4 {
+		cms, err := getCM4(config, ifs)
+		if err != nil {
+			return err
+		}
+
+		ipv4Low, err := listener4(config, ifs, mdnsPort)
+		if err != nil {
+			return err
+		}
+		ipv4High, err := listener4(config, ifs, 0)
+		if err != nil {
+			return err
+		}
+
+		s.ipv4CMs = cms
+		s.ipv4Dst = &net.UDPAddr{IP: net.ParseIP(ipv4mdns), Port: mdnsPort}
+		s.ipv4Low = ipv4Low
+		s.ipv4High = ipv4High
+	}
+
+	if !config.DisableIPv6 {
+		cms, err := getCM6(config, ifs)
+		if err != nil {
+			return err
+		}
+
+		ipv6Low, err := listener6(config, ifs, mdnsPort)
+		if err != nil {
+			return err
+		}
+		ipv6High, err := listener6(config, ifs, 0)
+		if err != nil {
+			return err
+		}
+
+		s.ipv6CMs = cms
+		s.ipv6Dst = &net.UDPAddr{IP: net.ParseIP(ipv6mdns), Port: mdnsPort}
+		s.ipv6Low = ipv6Low
+		s.ipv6High = ipv6High
+	}
+
+	transport, err := newTransport(uniqueID, config, routeTopics(config.Filters))
 	if err != nil {
 		return err
 	}
-	s.client = c
+	s.transport = transport
+
+	if err := s.transport.Subscribe(s.handleMeshMessage); err != nil {
+		return err
+	}
+
+	if s.ipv4Low != nil {
+		s.wg.Add(1)
+		go s.receive(ipv4Wire{s.ipv4Low}, "ipv4")
+	}
 
-	s.client.Subscribe(config.Topic, 0, s.send)
+	if s.ipv4High != nil {
+		s.wg.Add(1)
+		go s.receive(ipv4Wire{s.ipv4High}, "ipv4")
+	}
 
-	if ipv4Low != nil {
+	if s.ipv6Low != nil {
 		s.wg.Add(1)
-		go s.receive(ipv4Low)
+		go s.receive(ipv6Wire{s.ipv6Low}, "ipv6")
 	}
 
-	if ipv4High != nil {
+	if s.ipv6High != nil {
 		s.wg.Add(1)
-		go s.receive(ipv4High)
+		go s.receive(ipv6Wire{s.ipv6High}, "ipv6")
 	}
 
 	s.wg.Wait()
@@ -135,6 +236,160 @@ func StartServer(config Config) error {
 	return nil
 }
 
+// packetControlMessage is the address-family-agnostic subset of
+// ipv4.ControlMessage/ipv6.ControlMessage that receive/handleMeshMessage need: which
+// interface a packet arrived on or should be sent out, who sent it, and
+// the hop count it was sent with.
+type packetControlMessage struct {
+	IfIndex int
+	Src     net.IP
+	TTL     int
+}
+
+// wireConn unifies *ipv4.PacketConn and *ipv6.PacketConn so
+// receive/handleMeshMessage can be written once and run over either multicast socket.
+type wireConn interface {
+	ReadFrom(b []byte) (n int, cm *packetControlMessage, src net.Addr, err error)
+	WriteTo(b []byte, cm *packetControlMessage, dst net.Addr) (n int, err error)
+	ReadBatch(ms []batchMessage, flags int) (n int, err error)
+	WriteBatch(ms []batchMessage, flags int) (n int, err error)
+}
+
+// batchMessage is one slot of a ReadBatch/WriteBatch ring: a pooled
+// buffer plus the address-family-agnostic control message describing
+// where it came from (after a read) or which interface to send it out
+// of (before a write).
+type batchMessage struct {
+	buf  []byte
+	n    int
+	addr net.Addr
+	cm   *packetControlMessage
+}
+
+// bufPool recycles the fixed-size buffers used by the batch read ring so
+// receive doesn't allocate a fresh 64 KiB slice per packet.
+var bufPool = sync.Pool{
+	New: func() interface{} { return make([]byte, bufSize) },
+}
+
+type ipv4Wire struct {
+	*ipv4.PacketConn
+}
+
+func (w ipv4Wire) ReadFrom(b []byte) (int, *packetControlMessage, net.Addr, error) {
+	n, cm, src, err := w.PacketConn.ReadFrom(b)
+	if cm == nil {
+		return n, nil, src, err
+	}
+	return n, &packetControlMessage{IfIndex: cm.IfIndex, Src: cm.Src, TTL: cm.TTL}, src, err
+}
+
+func (w ipv4Wire) WriteTo(b []byte, cm *packetControlMessage, dst net.Addr) (int, error) {
+	var native *ipv4.ControlMessage
+	if cm != nil {
+		native = &ipv4.ControlMessage{IfIndex: cm.IfIndex}
+	}
+	return w.PacketConn.WriteTo(b, native, dst)
+}
+
+func (w ipv4Wire) ReadBatch(ms []batchMessage, flags int) (int, error) {
+	native := make([]ipv4.Message, len(ms))
+	for i := range ms {
+		native[i] = ipv4.Message{
+			Buffers: [][]byte{ms[i].buf},
+			OOB:     ipv4.NewControlMessage(ipv4.FlagTTL | ipv4.FlagSrc | ipv4.FlagInterface),
+		}
+	}
+
+	n, err := w.PacketConn.ReadBatch(native, flags)
+	if err != nil {
+		return n, err
+	}
+
+	for i := 0; i < n; i++ {
+		ms[i].n = native[i].N
+		ms[i].addr = native[i].Addr
+		cm := &ipv4.ControlMessage{}
+		if cerr := cm.Parse(native[i].OOB[:len(native[i].OOB)]); cerr == nil {
+			ms[i].cm = &packetControlMessage{IfIndex: cm.IfIndex, Src: cm.Src, TTL: cm.TTL}
+		}
+	}
+
+	return n, nil
+}
+
+func (w ipv4Wire) WriteBatch(ms []batchMessage, flags int) (int, error) {
+	native := make([]ipv4.Message, len(ms))
+	for i := range ms {
+		nm := ipv4.Message{Buffers: [][]byte{ms[i].buf[:ms[i].n]}, Addr: ms[i].addr}
+		if ms[i].cm != nil {
+			cm := &ipv4.ControlMessage{IfIndex: ms[i].cm.IfIndex}
+			nm.OOB = cm.Marshal()
+		}
+		native[i] = nm
+	}
+	return w.PacketConn.WriteBatch(native, flags)
+}
+
+type ipv6Wire struct {
+	*ipv6.PacketConn
+}
+
+func (w ipv6Wire) ReadFrom(b []byte) (int, *packetControlMessage, net.Addr, error) {
+	n, cm, src, err := w.PacketConn.ReadFrom(b)
+	if cm == nil {
+		return n, nil, src, err
+	}
+	return n, &packetControlMessage{IfIndex: cm.IfIndex, Src: cm.Src, TTL: cm.HopLimit}, src, err
+}
+
+func (w ipv6Wire) WriteTo(b []byte, cm *packetControlMessage, dst net.Addr) (int, error) {
+	var native *ipv6.ControlMessage
+	if cm != nil {
+		native = &ipv6.ControlMessage{IfIndex: cm.IfIndex}
+	}
+	return w.PacketConn.WriteTo(b, native, dst)
+}
+
+func (w ipv6Wire) ReadBatch(ms []batchMessage, flags int) (int, error) {
+	native := make([]ipv6.Message, len(ms))
+	for i := range ms {
+		native[i] = ipv6.Message{
+			Buffers: [][]byte{ms[i].buf},
+			OOB:     ipv6.NewControlMessage(ipv6.FlagHopLimit | ipv6.FlagSrc | ipv6.FlagInterface),
+		}
+	}
+
+	n, err := w.PacketConn.ReadBatch(native, flags)
+	if err != nil {
+		return n, err
+	}
+
+	for i := 0; i < n; i++ {
+		ms[i].n = native[i].N
+		ms[i].addr = native[i].Addr
+		cm := &ipv6.ControlMessage{}
+		if cerr := cm.Parse(native[i].OOB[:len(native[i].OOB)]); cerr == nil {
+			ms[i].cm = &packetControlMessage{IfIndex: cm.IfIndex, Src: cm.Src, TTL: cm.HopLimit}
+		}
+	}
+
+	return n, nil
+}
+
+func (w ipv6Wire) WriteBatch(ms []batchMessage, flags int) (int, error) {
+	native := make([]ipv6.Message, len(ms))
+	for i := range ms {
+		nm := ipv6.Message{Buffers: [][]byte{ms[i].buf[:ms[i].n]}, Addr: ms[i].addr}
+		if ms[i].cm != nil {
+			cm := &ipv6.ControlMessage{IfIndex: ms[i].cm.IfIndex}
+			nm.OOB = cm.Marshal()
+		}
+		native[i] = nm
+	}
+	return w.PacketConn.WriteBatch(native, flags)
+}
+
 // Check filters to deny messages in from/out to the wire
 func (s *Server) discardMessage(msg dns.Msg) bool {
 	if s.filterDeny && labelMatch(msg, s.filterRegex) {
@@ -150,103 +405,557 @@ func (s *Server) discardMessage(msg dns.Msg) bool {
 	return false
 }
 
-// Start loop to pull multicast broadcasts off the wire and send them to MQTT
-func (s *Server) receive(p *ipv4.PacketConn) {
-	defer s.wg.Done()
+// registerQuery makes the Server notify notify every time it sees a
+// response (locally, or relayed from a peer) matching re for queryID.
+func (s *Server) registerQuery(queryID string, re *regexp.Regexp, notify func(dm dns.Msg, segment string)) {
+	s.queriesMu.Lock()
+	defer s.queriesMu.Unlock()
 
-	for {
-		b := make([]byte, bufSize)
-		n, cm, _, err := p.ReadFrom(b)
-		if err != nil {
-			log.Errorf("Error reading packet from wire: %v", err)
+	if s.queries == nil {
+		s.queries = make(map[string]*activeQuery)
+	}
+	s.queries[queryID] = &activeQuery{re: re, notify: notify}
+}
+
+func (s *Server) unregisterQuery(queryID string) {
+	s.queriesMu.Lock()
+	defer s.queriesMu.Unlock()
+
+	delete(s.queries, queryID)
+}
+
+// matchActiveQueries checks a response captured off the local wire
+// against every registered query. A match is delivered to that query's
+// notify callback and, since the matching query may have been started by
+// a remote peer, rebroadcast tagged with its QueryID so that peer's
+// Resolver picks it up too.
+func (s *Server) matchActiveQueries(dm dns.Msg, data []byte, family string) {
+	if !dm.Response {
+		return
+	}
+
+	s.queriesMu.Lock()
+	defer s.queriesMu.Unlock()
+
+	for queryID, q := range s.queries {
+		if !labelMatch(dm, []*regexp.Regexp{q.re}) {
 			continue
 		}
 
-		if cm == nil {
-			log.Error("Received no ControlMessage from packet")
-			continue
+		q.notify(dm, family)
+
+		if err := s.transport.Publish(s.config.Topic, Msg{Sender: s.uniqueID, Data: data, Family: family, QueryID: queryID}); err != nil {
+			log.Errorf("Error publishing resolver answer to mesh: %v", err)
 		}
+	}
+}
 
-		if cm.TTL == s.config.FilterTTL {
-			log.Debug("Discarding packet with filter TTL")
-			log.Tracef("Discarding packet with filter TTL: %+v\n", cm)
-			continue
+// deliverQueryResult hands a resolver answer relayed from a peer to the
+// matching locally-registered query, if this node owns one. notify is
+// called with queriesMu held, the same as matchActiveQueries, so it's
+// serialized against unregisterQuery and can't run after the query's
+// result channel has been closed.
+func (s *Server) deliverQueryResult(queryID string, dm dns.Msg, segment string) {
+	s.queriesMu.Lock()
+	defer s.queriesMu.Unlock()
+
+	if q, ok := s.queries[queryID]; ok {
+		q.notify(dm, segment)
+	}
+}
+
+// injectQuery transmits a resolver query (received locally or relayed
+// from a peer) onto the local wire for the given family, the same way
+// handleMeshMessage rebroadcasts ordinary mesh traffic.
+func (s *Server) injectQuery(data []byte, family string) error {
+	var p wireConn
+	var cms []*packetControlMessage
+	var dst *net.UDPAddr
+
+	switch family {
+	case "ipv6":
+		if s.ipv6High == nil {
+			return fmt.Errorf("IPv6 is disabled on this node")
 		}
+		p = ipv6Wire{s.ipv6High}
+		cms = cmsFromIPv6(s.ipv6CMs)
+		dst = s.ipv6Dst
+	default:
+		if s.ipv4High == nil {
+			return fmt.Errorf("IPv4 is disabled on this node")
+		}
+		p = ipv4Wire{s.ipv4High}
+		cms = cmsFromIPv4(s.ipv4CMs)
+		dst = s.ipv4Dst
+	}
 
-		if ipDenied(cm.Src, s.config.DenyIP) {
-			log.Debugf("Discarding packet from denied IP: %s", cm.Src)
-			log.Tracef("Discarding packet from denied IP: %+v\n", cm)
-			continue
+	batch := make([]batchMessage, len(cms))
+	for i, cm := range cms {
+		batch[i] = batchMessage{buf: data, n: len(data), addr: dst, cm: cm}
+	}
+
+	_, err := p.WriteBatch(batch, 0)
+	return err
+}
+
+// activeFamilies returns the multicast families ("ipv4", "ipv6") this
+// node has a socket up for, so a Resolver query can be injected onto
+// every wire it can actually reach instead of assuming IPv4.
+func (s *Server) activeFamilies() []string {
+	var families []string
+	if s.ipv4High != nil {
+		families = append(families, "ipv4")
+	}
+	if s.ipv6High != nil {
+		families = append(families, "ipv6")
+	}
+	return families
+}
+
+// Start loop to pull multicast broadcasts off the wire in batches and
+// fan them out to a worker pool that publishes them to the mesh transport.
+func (s *Server) receive(p wireConn, family string) {
+	defer s.wg.Done()
+
+	batchSize := s.config.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	workers := s.config.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	jobs := make(chan batchMessage, batchSize)
+	var workerWg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		workerWg.Add(1)
+		go func() {
+			defer workerWg.Done()
+			for m := range jobs {
+				s.handlePacket(m, family)
+				bufPool.Put(m.buf[:cap(m.buf)])
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		workerWg.Wait()
+	}()
+
+	ring := make([]batchMessage, batchSize)
+	for {
+		for i := range ring {
+			ring[i] = batchMessage{buf: bufPool.Get().([]byte)}
 		}
 
-		msg := dns.Msg{}
-		err = msg.Unpack(b[:n])
+		n, err := p.ReadBatch(ring, 0)
 		if err != nil {
-			log.Warnf("Error parsing packet from wire: %v", err)
+			log.Errorf("Error reading packet batch from wire: %v", err)
+			for i := range ring {
+				bufPool.Put(ring[i].buf)
+			}
+			continue
 		}
-		log.Tracef("Received message from wire: %+v", msg)
 
-		if s.discardMessage(msg) {
-			log.Debugf("Discarding message from wire: %s", cm.Src)
-			continue
+		for i := 0; i < n; i++ {
+			jobs <- ring[i]
+		}
+		for i := n; i < len(ring); i++ {
+			bufPool.Put(ring[i].buf)
+		}
+	}
+}
+
+// handlePacket applies the deny-IP/filter-TTL/label filters to a single
+// packet pulled off the wire and, if it survives, publishes it to the mesh
+// transport.
+func (s *Server) handlePacket(m batchMessage, family string) {
+	if m.cm == nil {
+		log.Error("Received no ControlMessage from packet")
+		return
+	}
+
+	if m.cm.TTL == s.config.FilterTTL {
+		log.Debug("Discarding packet with filter TTL")
+		log.Tracef("Discarding packet with filter TTL: %+v\n", m.cm)
+		return
+	}
+
+	if ipDenied(m.cm.Src, s.config.DenyIP) {
+		log.Debugf("Discarding packet from denied IP: %s", m.cm.Src)
+		log.Tracef("Discarding packet from denied IP: %+v\n", m.cm)
+		return
+	}
+
+	msg := dns.Msg{}
+	if err := msg.Unpack(m.buf[:m.n]); err != nil {
+		log.Warnf("Error parsing packet from wire: %v", err)
+	}
+	log.Tracef("Received message from wire: %+v", msg)
+
+	if s.discardMessage(msg) {
+		log.Debugf("Discarding message from wire: %s", m.cm.Src)
+		return
+	}
+
+	s.matchActiveQueries(msg, m.buf[:m.n], family)
+
+	data := m.buf[:m.n]
+	topic := s.config.Topic
+
+	if s.pipeline != nil {
+		meta := PacketMeta{SourceIP: m.cm.Src, Interface: ifName(m.cm.IfIndex), Direction: DirectionInbound}
+
+		out, route, ok := s.pipeline.Run(msg, meta)
+		if !ok {
+			log.Debugf("Filter pipeline dropped message from %s", m.cm.Src)
+			return
+		}
+		if route != "" {
+			topic = route
 		}
 
-		jsonMsg, err := json.Marshal(Msg{Sender: s.uniqueID, Data: b[:n]})
+		packed, err := out.Pack()
 		if err != nil {
-			log.Errorf("Error marshalling message from wire: %v", err)
+			log.Errorf("Error repacking message after filter pipeline: %v", err)
+			return
 		}
-		s.client.Publish(s.config.Topic, 0, false, jsonMsg)
-		log.Debug("Sent message to mesh")
+		data = packed
 	}
+
+	if err := s.transport.Publish(topic, Msg{Sender: s.uniqueID, Data: data, Family: family}); err != nil {
+		log.Errorf("Error publishing message to mesh: %v", err)
+		return
+	}
+	log.Debug("Sent message to mesh")
 }
 
-// Accept messages from NATS and send them out on the wire
-func (s *Server) send(client mqtt.Client, msg mqtt.Message) {
-	m := Msg{}
-	err := json.Unmarshal(msg.Payload(), &m)
+// ifName resolves a ControlMessage interface index to its name, for the
+// filter pipeline's PacketMeta. Returns "" if the interface can't be
+// looked up (e.g. it was removed between the read and this call).
+func ifName(index int) string {
+	iface, err := net.InterfaceByIndex(index)
 	if err != nil {
-		log.Errorf("Error unmarshalling message from mesh: %v", err)
-		return
+		return ""
 	}
+	return iface.Name
+}
 
+// handleMeshMessage is invoked by the active Transport for every Msg
+// received from a peer, and sends it out on the matching wire.
+// Self-loop suppression happens here, keyed off uniqueID, so it's shared
+// by every transport implementation. Repeated copies of the same Msg from
+// a peer are not deduplicated.
+func (s *Server) handleMeshMessage(m Msg) {
 	if m.Sender == s.uniqueID {
 		log.Debug("Ignoring mesh message from self")
 		return
 	}
 
 	dm := dns.Msg{}
-	err = dm.Unpack(m.Data)
-	if err != nil {
+	if err := dm.Unpack(m.Data); err != nil {
 		log.Warnf("Error parsing mesh packet: %v", err)
 		return
 	}
 
+	if m.QueryID != "" {
+		if dm.Response {
+			s.deliverQueryResult(m.QueryID, dm, m.Family)
+			return
+		}
+		if len(dm.Question) > 0 {
+			// Register the peer's query so matchActiveQueries forwards the
+			// answers seen on this wire back to it under the same QueryID.
+			re := regexp.MustCompile(regexp.QuoteMeta(strings.TrimSuffix(dm.Question[0].Name, ".")))
+			s.registerQuery(m.QueryID, re, func(dns.Msg, string) {})
+			time.AfterFunc(relayQueryTimeout, func() { s.unregisterQuery(m.QueryID) })
+		}
+		if err := s.injectQuery(m.Data, m.Family); err != nil {
+			log.Debugf("Unable to transmit resolver query from %s: %v", m.Sender, err)
+		}
+		return
+	}
+
 	if s.discardMessage(dm) {
 		log.Debugf("Discarding message from sender: %s", m.Sender)
 		return
 	}
 
-	var p *ipv4.PacketConn
+	var p wireConn
+	var cms []*packetControlMessage
+	var dst *net.UDPAddr
+
 	match := labelMatch(dm, s.portRegex)
-	if (s.config.HighPort && match) || (!s.config.HighPort && !match) {
-		p = s.ipv4Low
-		log.Debugf("Mesh message to low port, from sender: %s", m.Sender)
-	} else {
-		p = s.ipv4High
-		log.Debugf("Mesh message to high port, from sender: %s", m.Sender)
+	switch m.Family {
+	case "ipv6":
+		if s.ipv6Low == nil && s.ipv6High == nil {
+			log.Debugf("Discarding IPv6 mesh message, IPv6 is disabled: %s", m.Sender)
+			return
+		}
+		if (s.config.HighPort && match) || (!s.config.HighPort && !match) {
+			p = ipv6Wire{s.ipv6Low}
+			log.Debugf("Mesh message to low port, from sender: %s", m.Sender)
+		} else {
+			p = ipv6Wire{s.ipv6High}
+			log.Debugf("Mesh message to high port, from sender: %s", m.Sender)
+		}
+		cms = cmsFromIPv6(s.ipv6CMs)
+		dst = s.ipv6Dst
+	default:
+		if s.ipv4Low == nil && s.ipv4High == nil {
+			log.Debugf("Discarding IPv4 mesh message, IPv4 is disabled: %s", m.Sender)
+			return
+		}
+		if (s.config.HighPort && match) || (!s.config.HighPort && !match) {
+			p = ipv4Wire{s.ipv4Low}
+			log.Debugf("Mesh message to low port, from sender: %s", m.Sender)
+		} else {
+			p = ipv4Wire{s.ipv4High}
+			log.Debugf("Mesh message to high port, from sender: %s", m.Sender)
+		}
+		cms = cmsFromIPv4(s.ipv4CMs)
+		dst = s.ipv4Dst
+	}
+
+	batch := make([]batchMessage, len(cms))
+	for i, cm := range cms {
+		batch[i] = batchMessage{buf: m.Data, n: len(m.Data), addr: dst, cm: cm}
 	}
 
-	for _, cm := range s.ipv4CMs {
-		if _, err := p.WriteTo(m.Data, cm, s.ipv4Dst); err != nil {
-			log.Errorf("Unable to send broadcast to wire: %v", err)
+	if _, err := p.WriteBatch(batch, 0); err != nil {
+		log.Errorf("Unable to send broadcast to wire: %v", err)
+	}
+
+	log.Tracef("Rebroadcast message to wire: %+v", m)
+}
+
+func cmsFromIPv4(native []*ipv4.ControlMessage) []*packetControlMessage {
+	cms := make([]*packetControlMessage, len(native))
+	for i, cm := range native {
+		cms[i] = &packetControlMessage{IfIndex: cm.IfIndex}
+	}
+	return cms
+}
+
+func cmsFromIPv6(native []*ipv6.ControlMessage) []*packetControlMessage {
+	cms := make([]*packetControlMessage, len(native))
+	for i, cm := range native {
+		cms[i] = &packetControlMessage{IfIndex: cm.IfIndex}
+	}
+	return cms
+}
+
+// Transport carries Msg payloads between mesh nodes. mqttTransport is the
+// default, brokered implementation; gossipTransport is a brokerless
+// alternative built on memberlist. Server only depends on this interface,
+// so self-loop suppression in handleMeshMessage works the same
+// regardless of which one is active.
+type Transport interface {
+	Publish(topic string, msg Msg) error
+	Subscribe(handler func(Msg)) error
+	Close() error
+}
+
+// newTransport builds the Transport selected by config.Transport,
+// defaulting to the MQTT broker used before gossip support existed.
+// extraTopics are additional MQTT topics (e.g. from RouteTopic pipeline
+// stages) to subscribe to beyond config.Topic; gossip ignores them.
+func newTransport(uniqueID string, config Config, extraTopics []string) (Transport, error) {
+	switch config.Transport {
+	case "gossip":
+		return newGossipTransport(uniqueID, config)
+	case "", "mqtt":
+		return newMQTTTransport(uniqueID, config, extraTopics)
+	default:
+		return nil, fmt.Errorf("unknown transport '%s', must be 'mqtt' or 'gossip'", config.Transport)
+	}
+}
+
+// mqttTransport publishes/subscribes Msg payloads as JSON over MQTT via
+// the existing paho client. topic is the default publish destination;
+// topics is the full set subscribed to, which grows beyond topic when a
+// RouteTopic pipeline stage shards traffic onto dedicated sub-topics.
+type mqttTransport struct {
+	client mqtt.Client
+	topic  string
+	topics []string
+}
+
+func newMQTTTransport(uniqueID string, config Config, extraTopics []string) (*mqttTransport, error) {
+	client, err := connect(uniqueID, config.Server, config.TLS, config.Topic)
+	if err != nil {
+		return nil, err
+	}
+	return &mqttTransport{client: client, topic: config.Topic, topics: append([]string{config.Topic}, extraTopics...)}, nil
+}
+
+func (t *mqttTransport) Publish(topic string, msg Msg) error {
+	if topic == "" {
+		topic = t.topic
+	}
+
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("error marshalling message for mesh: %v", err)
+	}
+	token := t.client.Publish(topic, 0, false, jsonMsg)
+	token.Wait()
+	return token.Error()
+}
+
+func (t *mqttTransport) Subscribe(handler func(Msg)) error {
+	onMessage := func(c mqtt.Client, mqttMsg mqtt.Message) {
+		var msg Msg
+		if err := json.Unmarshal(mqttMsg.Payload(), &msg); err != nil {
+			log.Errorf("Error unmarshalling message from mesh: %v", err)
+			return
 		}
+		handler(msg)
+	}
+
+	for _, topic := range t.topics {
+		token := t.client.Subscribe(topic, 0, onMessage)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("error subscribing to topic '%s': %v", topic, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *mqttTransport) Close() error {
+	t.client.Disconnect(250)
+	return nil
+}
+
+// gossipTransport exchanges Msg payloads as memberlist user messages,
+// avoiding the need for a central MQTT broker. Publish queues a broadcast
+// that memberlist piggybacks on its UDP gossip to peers, so delivery is not
+// guaranteed; inbound messages arrive via meshDelegate.NotifyMsg.
+type gossipTransport struct {
+	ml         *memberlist.Memberlist
+	broadcasts *memberlist.TransmitLimitedQueue
+	handler    func(Msg)
+}
+
+func newGossipTransport(uniqueID string, config Config) (*gossipTransport, error) {
+	t := &gossipTransport{}
+
+	mc := memberlist.DefaultLANConfig()
+	mc.Name = uniqueID
+	mc.Delegate = &meshDelegate{transport: t}
+	if config.Gossip.BindAddr != "" {
+		mc.BindAddr = config.Gossip.BindAddr
+	}
+	if config.Gossip.ProbeInterval > 0 {
+		mc.ProbeInterval = config.Gossip.ProbeInterval
+	}
+	if config.Gossip.EncryptionKey != "" {
+		mc.SecretKey = []byte(config.Gossip.EncryptionKey)
+	}
+
+	ml, err := memberlist.Create(mc)
+	if err != nil {
+		return nil, fmt.Errorf("error starting gossip transport: %v", err)
+	}
+
+	if len(config.Gossip.Seeds) > 0 {
+		if _, err := ml.Join(config.Gossip.Seeds); err != nil {
+			ml.Shutdown()
+			return nil, fmt.Errorf("error joining gossip seeds: %v", err)
+		}
+	}
+
+	t.ml = ml
+	t.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       ml.NumMembers,
+		RetransmitMult: 3,
+	}
+
+	return t, nil
+}
+
+// Publish gossips msg to every known peer. Gossip has no notion of
+// topics, so topic is ignored; sharding traffic via RouteTopic only
+// applies to the MQTT transport.
+func (t *gossipTransport) Publish(topic string, msg Msg) error {
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("error marshalling message for mesh: %v", err)
+	}
+	t.broadcasts.QueueBroadcast(&gossipBroadcast{msg: jsonMsg})
+	return nil
+}
+
+func (t *gossipTransport) Subscribe(handler func(Msg)) error {
+	t.handler = handler
+	return nil
+}
+
+func (t *gossipTransport) Close() error {
+	if err := t.ml.Leave(5 * time.Second); err != nil {
+		return err
+	}
+	return t.ml.Shutdown()
+}
+
+// gossipBroadcast implements memberlist.Broadcast for a single queued Msg.
+type gossipBroadcast struct {
+	msg []byte
+}
+
+func (b *gossipBroadcast) Invalidates(other memberlist.Broadcast) bool { return false }
+func (b *gossipBroadcast) Message() []byte                             { return b.msg }
+func (b *gossipBroadcast) Finished()                                   {}
+
+// meshDelegate feeds inbound gossip user messages to the owning
+// gossipTransport's handler and serves its outbound broadcast queue.
+type meshDelegate struct {
+	transport *gossipTransport
+}
+
+func (d *meshDelegate) NodeMeta(limit int) []byte { return nil }
+
+func (d *meshDelegate) NotifyMsg(b []byte) {
+	if len(b) == 0 || d.transport.handler == nil {
+		return
+	}
+
+	var msg Msg
+	if err := json.Unmarshal(b, &msg); err != nil {
+		log.Errorf("Error unmarshalling gossip message: %v", err)
+		return
 	}
+	d.transport.handler(msg)
+}
 
-	log.Tracef("Rebroadcast message to wire: %+v", msg)
+func (d *meshDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return d.transport.broadcasts.GetBroadcasts(overhead, limit)
 }
 
-func connect(clientId string, uri *url.URL) (mqtt.Client, error) {
-	opts := createClientOptions(clientId, uri)
+func (d *meshDelegate) LocalState(join bool) []byte            { return nil }
+func (d *meshDelegate) MergeRemoteState(buf []byte, join bool) {}
+
+func connect(clientId string, uri *url.URL, tlsConfig TLSConfig, topic string) (mqtt.Client, error) {
+	onConnect := func(c mqtt.Client) {
+		log.Info("Connected to mesh broker")
+		if token := c.Publish(presenceTopic(topic, clientId), 0, true, "online"); token.Wait() && token.Error() != nil {
+			log.Errorf("Error publishing presence announcement: %v", token.Error())
+		}
+	}
+
+	onConnectionLost := func(c mqtt.Client, err error) {
+		log.Warnf("Lost connection to mesh broker, will auto-reconnect: %v", err)
+	}
+
+	opts, err := createClientOptions(clientId, uri, tlsConfig, topic, onConnect, onConnectionLost)
+	if err != nil {
+		return nil, err
+	}
+
 	client := mqtt.NewClient(opts)
 	token := client.Connect()
 	for !token.WaitTimeout(3 * time.Second) {
@@ -257,14 +966,213 @@ func connect(clientId string, uri *url.URL) (mqtt.Client, error) {
 	return client, nil
 }
 
-func createClientOptions(clientId string, uri *url.URL) *mqtt.ClientOptions {
+func createClientOptions(clientId string, uri *url.URL, tlsConfig TLSConfig, topic string, onConnect mqtt.OnConnectHandler, onConnectionLost mqtt.ConnectionLostHandler) (*mqtt.ClientOptions, error) {
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s", uri.Host))
+
+	scheme := uri.Scheme
+	if scheme == "" {
+		scheme = "tcp"
+	}
+	broker := url.URL{Scheme: scheme, Host: uri.Host, Path: uri.Path, RawQuery: uri.RawQuery}
+	opts.AddBroker(broker.String())
+
+	switch scheme {
+	case "ssl", "tls", "wss":
+		tc, err := buildTLSConfig(tlsConfig, uri.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("error building TLS config for mesh broker: %v", err)
+		}
+		opts.SetTLSConfig(tc)
+	}
+
 	opts.SetUsername(uri.User.Username())
 	password, _ := uri.User.Password()
 	opts.SetPassword(password)
 	opts.SetClientID(clientId)
-	return opts
+
+	// A mesh node dropping silently is a real failure mode, so reconnect
+	// with backoff and keep queued subscriptions across the gap rather
+	// than starting a fresh, empty session.
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetMaxReconnectInterval(2 * time.Minute)
+	opts.SetCleanSession(false)
+	opts.SetOnConnectHandler(onConnect)
+	opts.SetConnectionLostHandler(onConnectionLost)
+	opts.SetWill(presenceTopic(topic, clientId), "offline", 0, true)
+
+	return opts, nil
+}
+
+// buildTLSConfig assembles the tls.Config used for ssl:// and wss://
+// brokers, including mTLS client certificates and custom CA roots.
+func buildTLSConfig(config TLSConfig, serverName string) (*tls.Config, error) {
+	tc := &tls.Config{
+		InsecureSkipVerify: config.Insecure,
+	}
+
+	if config.ServerName != "" {
+		tc.ServerName = config.ServerName
+	} else {
+		tc.ServerName = serverName
+	}
+
+	if config.CAFile != "" {
+		ca, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file '%s': %v", config.CAFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in CA file '%s'", config.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate/key: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+// presenceTopic returns the per-node topic a node announces its
+// arrival/departure on, derived from the shared mesh topic.
+func presenceTopic(topic, clientId string) string {
+	return fmt.Sprintf("%s/presence/%s", topic, clientId)
+}
+
+// getInterfaces returns the multicast-capable network interfaces to
+// bridge mDNS traffic on. If config.ListenIP is set, only the interface
+// carrying that address is returned; otherwise every multicast-capable
+// interface is used.
+func getInterfaces(config Config) ([]net.Interface, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("error listing network interfaces: %v", err)
+	}
+
+	var ifs []net.Interface
+	for _, iface := range all {
+		if iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+
+		if config.ListenIP != "" {
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+
+			var match bool
+			for _, addr := range addrs {
+				ip, _, err := net.ParseCIDR(addr.String())
+				if err == nil && ip.String() == config.ListenIP {
+					match = true
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+		}
+
+		ifs = append(ifs, iface)
+	}
+
+	if len(ifs) == 0 {
+		return nil, fmt.Errorf("no multicast-capable interfaces found")
+	}
+
+	return ifs, nil
+}
+
+// getCM4 builds the per-interface IPv4 control messages used to send a
+// copy of each outgoing packet out of every bridged interface.
+func getCM4(config Config, ifs []net.Interface) ([]*ipv4.ControlMessage, error) {
+	cms := make([]*ipv4.ControlMessage, len(ifs))
+	for i, iface := range ifs {
+		cms[i] = &ipv4.ControlMessage{IfIndex: iface.Index}
+	}
+	return cms, nil
+}
+
+// getCM6 mirrors getCM4 for the IPv6 multicast socket.
+func getCM6(config Config, ifs []net.Interface) ([]*ipv6.ControlMessage, error) {
+	cms := make([]*ipv6.ControlMessage, len(ifs))
+	for i, iface := range ifs {
+		cms[i] = &ipv6.ControlMessage{IfIndex: iface.Index}
+	}
+	return cms, nil
+}
+
+// listener4 opens an IPv4 UDP socket bound to port (mdnsPort for the
+// "low" listener, or 0 for an ephemeral "high" one) and joins the mDNS
+// multicast group on every interface in ifs.
+func listener4(config Config, ifs []net.Interface, port int) (*ipv4.PacketConn, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("error opening IPv4 socket on port %d: %v", port, err)
+	}
+
+	p := ipv4.NewPacketConn(conn)
+	if err := p.SetControlMessage(ipv4.FlagTTL|ipv4.FlagSrc|ipv4.FlagInterface, true); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error enabling IPv4 control messages: %v", err)
+	}
+
+	group := &net.UDPAddr{IP: net.ParseIP(ipv4mdns)}
+	var joined int
+	for _, iface := range ifs {
+		if err := p.JoinGroup(&iface, group); err != nil {
+			log.Debugf("Unable to join IPv4 multicast group on %s: %v", iface.Name, err)
+			continue
+		}
+		joined++
+	}
+
+	if joined == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("unable to join IPv4 multicast group on any interface")
+	}
+
+	return p, nil
+}
+
+// listener6 mirrors listener4 for the IPv6 multicast socket.
+func listener6(config Config, ifs []net.Interface, port int) (*ipv6.PacketConn, error) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified, Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("error opening IPv6 socket on port %d: %v", port, err)
+	}
+
+	p := ipv6.NewPacketConn(conn)
+	if err := p.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagSrc|ipv6.FlagInterface, true); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error enabling IPv6 control messages: %v", err)
+	}
+
+	group := &net.UDPAddr{IP: net.ParseIP(ipv6mdns)}
+	var joined int
+	for _, iface := range ifs {
+		if err := p.JoinGroup(&iface, group); err != nil {
+			log.Debugf("Unable to join IPv6 multicast group on %s: %v", iface.Name, err)
+			continue
+		}
+		joined++
+	}
+
+	if joined == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("unable to join IPv6 multicast group on any interface")
+	}
+
+	return p, nil
 }
 
 // Compile the high/low port filters and allow/deny list filters
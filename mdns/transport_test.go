@@ -0,0 +1,76 @@
+package mdns
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewTransportUnknown(t *testing.T) {
+	_, err := newTransport("node-1", Config{Transport: "carrier-pigeon"}, nil)
+	if err == nil {
+		t.Fatal("newTransport() with an unknown transport returned nil error")
+	}
+}
+
+func TestNewTransportGossip(t *testing.T) {
+	config := Config{
+		Transport: "gossip",
+		Gossip:    GossipConfig{BindAddr: "127.0.0.1"},
+	}
+
+	transport, err := newTransport("node-1", config, nil)
+	if err != nil {
+		t.Fatalf("newTransport() error = %v", err)
+	}
+	defer transport.Close()
+
+	if _, ok := transport.(*gossipTransport); !ok {
+		t.Errorf("newTransport() with Transport: \"gossip\" returned %T, want *gossipTransport", transport)
+	}
+}
+
+// TestMeshDelegateNotifyMsg covers the gossip receive path: a raw memberlist
+// user message decoded back into the Msg it was marshalled from and handed
+// to the transport's Subscribe handler.
+func TestMeshDelegateNotifyMsg(t *testing.T) {
+	var got Msg
+	calls := 0
+	d := &meshDelegate{transport: &gossipTransport{handler: func(msg Msg) {
+		calls++
+		got = msg
+	}}}
+
+	want := Msg{Sender: "node-2", Data: []byte("hello"), Family: "ipv4", QueryID: "abc123"}
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+
+	d.NotifyMsg(b)
+
+	if calls != 1 {
+		t.Fatalf("handler called %d times, want 1", calls)
+	}
+	if got.Sender != want.Sender || string(got.Data) != string(want.Data) || got.Family != want.Family || got.QueryID != want.QueryID {
+		t.Errorf("NotifyMsg() decoded = %+v, want %+v", got, want)
+	}
+}
+
+func TestMeshDelegateNotifyMsgIgnoresEmptyAndInvalid(t *testing.T) {
+	calls := 0
+	d := &meshDelegate{transport: &gossipTransport{handler: func(msg Msg) { calls++ }}}
+
+	d.NotifyMsg(nil)
+	d.NotifyMsg([]byte("not json"))
+
+	if calls != 0 {
+		t.Errorf("handler called %d times on empty/invalid input, want 0", calls)
+	}
+}
+
+// TestMeshDelegateNotifyMsgNilHandler guards against a panic on messages
+// that arrive before Subscribe has installed a handler.
+func TestMeshDelegateNotifyMsgNilHandler(t *testing.T) {
+	d := &meshDelegate{transport: &gossipTransport{}}
+	d.NotifyMsg([]byte(`{"Sender":"node-2"}`))
+}